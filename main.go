@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
 	"flag"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -19,17 +29,94 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/mivinci/lru"
 	"github.com/mivinci/mux"
-	"github.com/russross/blackfriday"
+	"github.com/yuin/goldmark"
+	emoji "github.com/yuin/goldmark-emoji"
+	meta "github.com/yuin/goldmark-meta"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"go.abhg.dev/goldmark/mermaid"
+	"golang.org/x/crypto/acme/autocert"
 	"gopkg.in/yaml.v2"
 )
 
 type Option struct {
-	Author string
-	Brand  string
-	Quote  string
-	GitHub string
-	Since  string
-	Cache  int
+	Author          string
+	Brand           string
+	Quote           string
+	GitHub          string
+	Since           string
+	Cache           int
+	BaseURL         string
+	FeedSize        int
+	ShutdownTimeout int // seconds
+	Markdown        MarkdownOption
+	TLS             TLSOption
+	CSP             map[string]string
+}
+
+// TLSOption configures HTTPS. Set Cert and Key for a static certificate,
+// or AutoCert (the hostnames the server answers for) to provision one
+// automatically via Let's Encrypt.
+type TLSOption struct {
+	Cert     string
+	Key      string
+	AutoCert []string
+}
+
+// MarkdownOption controls which goldmark extensions are used to render
+// posts. Every flag defaults to enabled; set any of them to false in
+// ink.yml to turn that extension off. The fields are *bool, not bool,
+// so that an explicit `false` can be told apart from leaving the field
+// unset: a plain bool's zero value is indistinguishable from "off".
+type MarkdownOption struct {
+	GFM           *bool
+	Emoji         *bool
+	Mermaid       *bool
+	AutoHeadingID *bool
+}
+
+// setDefaults turns on any extension ink.yml left unset, so an empty
+// `markdown:` block (or none at all) behaves the same as before this
+// option existed, while an explicit false for a single extension is
+// honored instead of being masked by the others' zero values.
+func (m *MarkdownOption) setDefaults() {
+	if m.GFM == nil {
+		m.GFM = boolPtr(true)
+	}
+	if m.Emoji == nil {
+		m.Emoji = boolPtr(true)
+	}
+	if m.Mermaid == nil {
+		m.Mermaid = boolPtr(true)
+	}
+	if m.AutoHeadingID == nil {
+		m.AutoHeadingID = boolPtr(true)
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func newRenderer(opt MarkdownOption) goldmark.Markdown {
+	exts := []goldmark.Extender{meta.Meta}
+	if opt.GFM != nil && *opt.GFM {
+		exts = append(exts, extension.GFM)
+	}
+	if opt.Emoji != nil && *opt.Emoji {
+		exts = append(exts, emoji.Emoji)
+	}
+	if opt.Mermaid != nil && *opt.Mermaid {
+		exts = append(exts, mermaid.NewExtender())
+	}
+
+	var popts []parser.Option
+	if opt.AutoHeadingID != nil && *opt.AutoHeadingID {
+		popts = append(popts, parser.WithAutoHeadingID())
+	}
+
+	return goldmark.New(
+		goldmark.WithExtensions(exts...),
+		goldmark.WithParserOptions(popts...),
+	)
 }
 
 func (o *Option) Load(path string) error {
@@ -45,6 +132,13 @@ func MustOpt() *Option {
 	if err := opt.Load("ink.yml"); err != nil {
 		panic(err)
 	}
+	opt.Markdown.setDefaults()
+	if opt.FeedSize == 0 {
+		opt.FeedSize = 20
+	}
+	if opt.ShutdownTimeout == 0 {
+		opt.ShutdownTimeout = 10
+	}
 	return opt
 }
 
@@ -64,9 +158,17 @@ type Post struct {
 	HTML     template.HTML
 	Time     time.Time
 	IsDir    bool
+
+	// Meta is the raw YAML frontmatter, if any. Description, Tags,
+	// Draft and Date are typed convenience fields parsed out of it.
+	Meta        map[string]interface{}
+	Description string
+	Tags        []string
+	Draft       bool
+	Date        time.Time
 }
 
-func (p *Post) Load(path string) error {
+func (p *Post) Load(path string, md goldmark.Markdown) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
@@ -84,12 +186,90 @@ func (p *Post) Load(path string) error {
 	p.Title = title
 	p.Category = pdir
 	p.Path = path
-	p.HTML = template.HTML(blackfriday.MarkdownCommon(buf.Bytes()))
 	p.Time = fi.ModTime()
 	p.Size = fi.Size()
+
+	ctx := parser.NewContext()
+	var out bytes.Buffer
+	if err := md.Convert(buf.Bytes(), &out, parser.WithContext(ctx)); err != nil {
+		return err
+	}
+	p.HTML = template.HTML(out.String())
+	p.loadMeta(meta.Get(ctx))
 	return nil
 }
 
+// loadMeta copies the frontmatter into p.Meta and fans out the fields
+// themes and feeds care about, falling back to the filename-derived
+// Title when the frontmatter doesn't set one.
+func (p *Post) loadMeta(m map[string]interface{}) {
+	if m == nil {
+		return
+	}
+	p.Meta = m
+	if title, ok := m["title"].(string); ok && title != "" {
+		p.Title = title
+	}
+	if desc, ok := m["description"].(string); ok {
+		p.Description = desc
+	}
+	if tags, ok := m["tags"].([]interface{}); ok {
+		for _, t := range tags {
+			if s, ok := t.(string); ok {
+				p.Tags = append(p.Tags, s)
+			}
+		}
+	}
+	if draft, ok := m["draft"].(bool); ok {
+		p.Draft = draft
+	}
+	if date, ok := m["date"].(string); ok {
+		if t, err := parseDate(date); err == nil {
+			p.Date = t
+		}
+	}
+}
+
+// parseDate accepts the handful of date layouts people actually type in
+// frontmatter.
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("ink: unrecognized date %q", s)
+}
+
+// readFrontMatter reads just the leading `---` YAML block of path
+// without rendering the rest of the file, so directory listings can
+// show a human title without paying for a full markdown conversion.
+func readFrontMatter(path string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() || strings.TrimSpace(sc.Text()) != "---" {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	for sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "---" {
+			m := map[string]interface{}{}
+			if err := yaml.Unmarshal(buf.Bytes(), &m); err != nil {
+				return nil, err
+			}
+			return m, nil
+		}
+		buf.WriteString(sc.Text())
+		buf.WriteByte('\n')
+	}
+	return nil, nil
+}
+
 type Category struct {
 	Name string
 	Path string
@@ -132,18 +312,39 @@ type MD struct {
 	Opt  *Option
 	root string
 	ext  string
+	dev  bool
+
+	renderer goldmark.Markdown
+	cache    *lru.Cache
+	dirs     *Dirs
+
+	subsMu     sync.Mutex
+	subs       []chan Event
+	debounceMu sync.Mutex
+	debounce   map[string]*time.Timer
+}
 
-	cache *lru.Cache
-	dirs  *Dirs
+// Event describes a change Watch picked up via fsnotify. Path is the
+// URL path of the affected post, so a subscriber can decide whether the
+// page it's showing needs to reload.
+type Event struct {
+	Path string
 }
 
-func New(root, ext string) *MD {
+// New builds the markdown cache rooted at root. When dev is true, posts
+// with `draft: true` frontmatter are kept in List/Hot/routes instead of
+// being hidden, so authors can preview drafts with `-dev`.
+func New(root, ext string, dev bool) *MD {
+	opt := MustOpt()
 	md := &MD{
-		root: root,
-		ext:  ext,
-		dirs: &Dirs{},
-		Opt:  MustOpt(),
-		fw:   MustWC(),
+		root:     root,
+		ext:      ext,
+		dev:      dev,
+		dirs:     &Dirs{},
+		Opt:      opt,
+		fw:       MustWC(),
+		renderer: newRenderer(opt.Markdown),
+		debounce: make(map[string]*time.Timer),
 	}
 	md.cache = lru.New(md.Opt.Cache)
 	md.cache.Evict = func(k, v interface{}) {}
@@ -178,6 +379,7 @@ func (m *MD) Watch() {
 			}
 			m.fw.Add(evt.Name)  // nolint:errcheck
 			m.dirs.Load(m.root) // nolint:errcheck
+			m.scheduleEvent(evt.Name)
 			log.Printf("%s\n", evt.String())
 		case fsnotify.Remove, fsnotify.Rename:
 			if m.Is(evt.Name) {
@@ -185,17 +387,107 @@ func (m *MD) Watch() {
 			}
 			m.fw.Remove(evt.Name) // nolint:errcheck
 			m.dirs.Load(m.root)   // nolint:errcheck
+			m.scheduleEvent(evt.Name)
 			log.Printf("%s\n", evt.String())
 		case fsnotify.Chmod:
+			m.scheduleEvent(evt.Name)
 			log.Printf("%s\n", evt.String())
 		}
 	}
+	m.closeSubscribers()
 }
 
 func (m *MD) Close() error {
 	return m.fw.Close()
 }
 
+// Subscribe returns a channel of Events for a dev-mode SSE client. The
+// channel is closed when Watch stops (see MD.Close) or when the
+// caller is done with it via Unsubscribe.
+func (m *MD) Subscribe() <-chan Event {
+	ch := make(chan Event, 8)
+	m.subsMu.Lock()
+	m.subs = append(m.subs, ch)
+	m.subsMu.Unlock()
+	return ch
+}
+
+func (m *MD) Unsubscribe(ch <-chan Event) {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	for i, c := range m.subs {
+		if c == ch {
+			close(c)
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *MD) closeSubscribers() {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	for _, ch := range m.subs {
+		close(ch)
+	}
+	m.subs = nil
+}
+
+func (m *MD) publish(path string) {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	for _, ch := range m.subs {
+		select {
+		case ch <- Event{Path: path}:
+		default: // slow subscriber, drop rather than block Watch
+		}
+	}
+}
+
+// scheduleEvent coalesces bursts of events for the same path (a Write
+// immediately followed by a Chmod, which is how many editors save) into
+// a single publish, fired once the path has been quiet for 100ms.
+func (m *MD) scheduleEvent(path string) {
+	m.debounceMu.Lock()
+	defer m.debounceMu.Unlock()
+	if t, ok := m.debounce[path]; ok {
+		t.Stop()
+	}
+	m.debounce[path] = time.AfterFunc(100*time.Millisecond, func() {
+		m.debounceMu.Lock()
+		delete(m.debounce, path)
+		m.debounceMu.Unlock()
+		m.publish(m.urlPath(path))
+	})
+}
+
+// urlPath turns a filesystem path under m.root into the URL path a
+// browser would be looking at, so a live-reload client can tell whether
+// the change affects the page it's showing.
+func (m *MD) urlPath(path string) string {
+	p := m.Clean(path)
+	if m.Is(path) {
+		p = strings.TrimSuffix(p, m.ext)
+	}
+	return foldIndexURL(p)
+}
+
+// foldIndexURL turns an extension-stripped, cache-relative post path
+// (e.g. "blog/index" or "" for the root) into the URL path it's served
+// at, folding an index post onto its directory's URL (see
+// Server.Handle's "/*" route) instead of a trailing ".../index". Used
+// by urlPath for live-reload, and by the feed/sitemap builders so an
+// index post is listed at the same URL it's actually reachable at.
+func foldIndexURL(p string) string {
+	if filepath.Base(p) == "index" {
+		p = strings.TrimSuffix(strings.TrimSuffix(p, "index"), "/")
+	}
+	if p == "" {
+		return "/"
+	}
+	return "/" + p
+}
+
 func (m *MD) Post(path string) (*Post, error) {
 	m.mu.RLock()
 	p, ok := m.cache.Get(path)
@@ -206,7 +498,7 @@ func (m *MD) Post(path string) (*Post, error) {
 	}
 	m.mu.RUnlock()
 	post := &Post{}
-	if err := post.Load(path); err != nil {
+	if err := post.Load(path, m.renderer); err != nil {
 		return nil, err
 	}
 	m.mu.Lock()
@@ -223,7 +515,7 @@ func (m *MD) Update(path string) error {
 		return nil
 	}
 	post := p.(*Post)
-	return post.Load(path)
+	return post.Load(path, m.renderer)
 }
 
 func (m *MD) Remove(path string) {
@@ -232,7 +524,16 @@ func (m *MD) Remove(path string) {
 	m.cache.Remove(path)
 }
 
-func (m *MD) List(dir string) (ps []*Post, err error) {
+// ListOptions controls how MD.List orders and paginates a directory's
+// entries.
+type ListOptions struct {
+	Sort   string // "name" (default), "size", or "time"
+	Order  string // "asc" (default) or "desc"
+	Limit  int    // 0 means unlimited
+	Offset int
+}
+
+func (m *MD) List(dir string, opts ListOptions) (ps []*Post, numDirs, numFiles int, err error) {
 	ps = make([]*Post, 0)
 	err = dfs(dir, func(path string, fi os.FileInfo) error {
 		if fi.IsDir() || m.Is(path) {
@@ -244,14 +545,60 @@ func (m *MD) List(dir string) (ps []*Post, err error) {
 			}
 			if fi.IsDir() {
 				p.IsDir = true
+			} else if fm, ferr := readFrontMatter(path); ferr == nil {
+				p.loadMeta(fm)
+			}
+			if p.Draft && !m.dev {
+				return nil
+			}
+			if p.IsDir {
+				numDirs++
+			} else {
+				numFiles++
 			}
 			ps = append(ps, p)
 		}
 		return nil
 	})
+	if err != nil {
+		return
+	}
+	sortPosts(ps, opts.Sort, opts.Order)
+	if opts.Offset > 0 {
+		if opts.Offset >= len(ps) {
+			ps = ps[:0]
+		} else {
+			ps = ps[opts.Offset:]
+		}
+	}
+	if opts.Limit > 0 && opts.Limit < len(ps) {
+		ps = ps[:opts.Limit]
+	}
 	return
 }
 
+// sortPosts orders a directory listing by name, size or time. Name sort
+// is case-insensitive; all three are stable so entries that tie keep
+// their filesystem order.
+func sortPosts(ps []*Post, by, order string) {
+	less := func(i, j int) bool {
+		switch by {
+		case "size":
+			return ps[i].Size < ps[j].Size
+		case "time":
+			return ps[i].Time.Before(ps[j].Time)
+		default:
+			return strings.ToLower(ps[i].Title) < strings.ToLower(ps[j].Title)
+		}
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		if order == "desc" {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+}
+
 func (m *MD) Hot() (ps []*Post, err error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -262,17 +609,46 @@ func (m *MD) Hot() (ps []*Post, err error) {
 		if title == "index" {
 			return nil
 		}
+		post := v.(*Post)
+		if post.Draft && !m.dev {
+			return nil
+		}
+		if post.Title != "" {
+			title = post.Title
+		}
 		ps = append(ps, &Post{
 			Path:     m.Clean(path),
 			Title:    title,
 			Category: pdir,
-			Time:     v.(*Post).Time,
+			Time:     post.Time,
 		})
 		return nil
 	})
 	return
 }
 
+// All walks every markdown file under m.root without rendering it, for
+// the sitemap, which must list pages that have never been requested
+// (and so never entered the cache). Drafts are omitted unless dev.
+func (m *MD) All() (ps []*Post, err error) {
+	ps = make([]*Post, 0)
+	err = dfs(m.root, func(path string, fi os.FileInfo) error {
+		if fi.IsDir() || !m.Is(path) {
+			return nil
+		}
+		p := &Post{Path: m.Clean(path), Time: fi.ModTime()}
+		if fm, ferr := readFrontMatter(path); ferr == nil {
+			p.loadMeta(fm)
+		}
+		if p.Draft && !m.dev {
+			return nil
+		}
+		ps = append(ps, p)
+		return nil
+	})
+	return
+}
+
 func (m *MD) Is(path string) bool {
 	return filepath.Ext(path) == m.ext
 }
@@ -331,6 +707,18 @@ func must(err error) {
 	}
 }
 
+// flagSet reports whether name was actually passed on the command line,
+// as opposed to left at its default.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func htmls(root string) []string {
 	ps := make([]string, 0)
 	dfs(root, func(path string, fi os.FileInfo) error { // nolint:errcheck
@@ -357,6 +745,35 @@ type Server struct {
 	tpl     *template.Template
 	root    string
 	assets  string
+
+	feed    pageCache
+	sitemap pageCache
+}
+
+// pageCache holds one lazily-built, fsnotify-invalidated response body
+// (the atom feed or sitemap), so repeat requests don't re-walk md/.
+type pageCache struct {
+	mu   sync.Mutex
+	data []byte
+	ok   bool
+}
+
+func (c *pageCache) get() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.data, c.ok
+}
+
+func (c *pageCache) set(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data, c.ok = data, true
+}
+
+func (c *pageCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ok = false
 }
 
 func NewServer(root, assets string) *Server {
@@ -364,12 +781,24 @@ func NewServer(root, assets string) *Server {
 		handler: mux.New(),
 		root:    root,
 		assets:  assets,
-		tpl:     newTemplate(root),
 	}
 }
 
-func newTemplate(root string) *template.Template {
-	t := template.New("ink").Funcs(funcMap)
+// newTemplate parses every *.html under root, with a hash func that
+// content-hashes files under root/static and assets (for cache-busting
+// query strings), a url func that prefixes baseURL onto a path (for
+// absolute links in a -build export), and a liveReload func themes call
+// from their base layout to inject the -dev live-reload script.
+func newTemplate(root, assets, baseURL string, dev bool) *template.Template {
+	fns := template.FuncMap{}
+	for k, v := range funcMap {
+		fns[k] = v
+	}
+	fns["hash"] = hashFunc(root, assets)
+	fns["url"] = absURL(baseURL)
+	fns["liveReload"] = liveReloadFunc(dev)
+
+	t := template.New("ink").Funcs(fns)
 	var err error
 	if t, err = t.ParseFiles(htmls(root)...); err != nil {
 		log.Fatalf("parse templates failed: %s\n", err)
@@ -384,6 +813,7 @@ var funcMap = template.FuncMap{
 	"trimRight": strings.TrimRight,
 	"clean":     clean,
 	"size":      size,
+	"humanTime": humanTime,
 }
 
 func clean(path string) string {
@@ -397,24 +827,160 @@ func size(i int64) string {
 	return fmt.Sprintf("%.1fkB", float64(i)/1024)
 }
 
-func (s *Server) Start(addr string) {
+// humanTime renders t as a relative duration, e.g. "3 days ago".
+func humanTime(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return pluralize(int(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return pluralize(int(d/time.Hour), "hour")
+	case d < 30*24*time.Hour:
+		return pluralize(int(d/(24*time.Hour)), "day")
+	case d < 365*24*time.Hour:
+		return pluralize(int(d/(30*24*time.Hour)), "month")
+	default:
+		return pluralize(int(d/(365*24*time.Hour)), "year")
+	}
+}
+
+func pluralize(n int, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("1 %s ago", unit)
+	}
+	return fmt.Sprintf("%d %ss ago", n, unit)
+}
+
+// hashFunc returns a template func that content-hashes a /static/* or
+// /assets/* reference, so themes can append it as a cache-busting query
+// string: {{.Path}}?v={{hash .Path}}.
+func hashFunc(htmlRoot, assets string) func(string) string {
+	return func(p string) string {
+		p = strings.TrimPrefix(p, "/")
+		var full string
+		switch {
+		case strings.HasPrefix(p, "static/"):
+			full = filepath.Join(htmlRoot, p)
+		case strings.HasPrefix(p, "assets/"):
+			full = filepath.Join(assets, strings.TrimPrefix(p, "assets/"))
+		default:
+			return ""
+		}
+		buf, err := ioutil.ReadFile(full)
+		if err != nil {
+			return ""
+		}
+		sum := sha1.Sum(buf)
+		return hex.EncodeToString(sum[:])[:8]
+	}
+}
+
+// absURL prefixes p with baseURL, so templates can emit portable
+// absolute links when the site is exported with -build. With no
+// baseURL configured it returns p unchanged.
+func absURL(baseURL string) func(string) string {
+	return func(p string) string {
+		if baseURL == "" {
+			return p
+		}
+		return strings.TrimRight(baseURL, "/") + "/" + strings.TrimLeft(p, "/")
+	}
+}
+
+// liveReloadScript opens an EventSource against /_ink/live and reloads
+// the page when a matching change comes in. It's only ever injected in
+// -dev (see liveReloadFunc).
+const liveReloadScript = `<script>
+(function () {
+	var es = new EventSource("/_ink/live");
+	es.onmessage = function (e) {
+		if (e.data === location.pathname) location.reload();
+	};
+})();
+</script>`
+
+// liveReloadFunc returns a template func themes call from their base
+// layout (e.g. {{liveReload}} before </body>) to get the -dev
+// live-reload script; outside -dev it renders nothing.
+func liveReloadFunc(dev bool) func() template.HTML {
+	return func() template.HTML {
+		if !dev {
+			return ""
+		}
+		return template.HTML(liveReloadScript)
+	}
+}
+
+// Start blocks serving addr until Close begins shutting the server
+// down; Close itself returns once in-flight requests have drained. TLS is
+// used when opt.TLS.Cert/Key are set, or provisioned automatically via
+// autocert when opt.TLS.AutoCert lists the hostnames to serve.
+func (s *Server) Start(addr string, opt *Option) {
 	s.server = &http.Server{
-		Handler: s.handler,
+		Handler: withCSP(s.handler, opt.CSP),
 		Addr:    addr,
 	}
-	log.Println(s.server.ListenAndServe())
+
+	var err error
+	switch {
+	case len(opt.TLS.AutoCert) > 0:
+		mgr := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(opt.TLS.AutoCert...),
+			Cache:      autocert.DirCache("autocert"),
+		}
+		s.server.TLSConfig = mgr.TLSConfig()
+		err = s.server.ListenAndServeTLS("", "")
+	case opt.TLS.Cert != "" && opt.TLS.Key != "":
+		err = s.server.ListenAndServeTLS(opt.TLS.Cert, opt.TLS.Key)
+	default:
+		err = s.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Println(err)
+	}
+}
+
+// Close drains in-flight requests (bounded by ctx) instead of slamming
+// open connections.
+func (s *Server) Close(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
 }
 
-func (s *Server) Close() error {
-	return s.server.Close()
+// withCSP sets a Content-Security-Policy header built from directive ->
+// value pairs in ink.yml, e.g. to lock down inline scripts once the
+// -dev live-reload script is disabled.
+func withCSP(h http.Handler, csp map[string]string) http.Handler {
+	if len(csp) == 0 {
+		return h
+	}
+	directives := make([]string, 0, len(csp))
+	for k, v := range csp {
+		directives = append(directives, k+" "+v)
+	}
+	sort.Strings(directives) // deterministic header ordering
+	value := strings.Join(directives, "; ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", value)
+		h.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) Handle(md *MD) {
+	s.tpl = newTemplate(s.root, s.assets, md.Opt.BaseURL, md.dev)
 	s.handler.Handle("GET", "/static/*", http.FileServer(http.Dir(s.root)))
 	s.handler.Handle("GET", "/assets/*", http.FileServer(http.Dir(s.assets)))
 	s.handler.HandleFunc("GET", "/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, filepath.Join(s.root, "static/favicon.ico"))
 	})
+	if md.dev {
+		s.handler.HandleFunc("GET", "/_ink/live", s.liveHandler(md))
+	}
+	go s.invalidateCachesOn(md)
+	s.handler.HandleFunc("GET", "/feed.atom", s.feedHandler(md))
+	s.handler.HandleFunc("GET", "/sitemap.xml", s.sitemapHandler(md))
 	s.handler.HandleFunc("GET", "/", func(w http.ResponseWriter, r *http.Request) {
 		ps, err := md.Hot()
 		if err != nil {
@@ -445,13 +1011,20 @@ func (s *Server) Handle(md *MD) {
 		if err != nil {
 			// 是分类且用户没有提供分类的自定义目录
 			if isDir {
-				list, err := md.List(dir)
+				opts := parseListOptions(r.URL.Query())
+				list, numDirs, numFiles, err := md.List(dir, opts)
 				if err == nil {
 					s.tpl.ExecuteTemplate(w, "posts", &ListView{ // nolint:errcheck
-						Option: md.Opt,
-						List:   list,
-						Title:  dirname,
-						Count:  len(list),
+						Option:         md.Opt,
+						List:           list,
+						Title:          dirname,
+						Count:          len(list),
+						NumDirs:        numDirs,
+						NumFiles:       numFiles,
+						ItemsLimitedTo: opts.Limit,
+						Sort:           opts.Sort,
+						Order:          opts.Order,
+						CanGoUp:        dir != md.root,
 					})
 					return
 				}
@@ -459,6 +1032,10 @@ func (s *Server) Handle(md *MD) {
 			s.tpl.ExecuteTemplate(w, "404", nil) // nolint:errcheck
 			return
 		}
+		if post.Draft && !md.dev {
+			s.tpl.ExecuteTemplate(w, "404", nil) // nolint:errcheck
+			return
+		}
 		if isDir {
 			post.Title = dirname
 		}
@@ -466,6 +1043,380 @@ func (s *Server) Handle(md *MD) {
 	})
 }
 
+// liveHandler serves /_ink/live: a Server-Sent Events stream of the
+// Events md.Watch picks up, so a browser tab can hot-reload itself.
+func (s *Server) liveHandler(md *MD) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+
+		ch := md.Subscribe()
+		defer md.Unsubscribe(ch)
+
+		for {
+			select {
+			case evt, ok := <-ch:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(w, "data: %s\n\n", evt.Path) // nolint:errcheck
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// invalidateCachesOn drops the feed/sitemap caches whenever md.Watch
+// sees a change, so the next request regenerates them. It returns once
+// md closes its subscribers (see MD.Close).
+func (s *Server) invalidateCachesOn(md *MD) {
+	for range md.Subscribe() {
+		s.feed.invalidate()
+		s.sitemap.invalidate()
+	}
+}
+
+func (s *Server) feedHandler(md *MD) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := s.feed.get()
+		if !ok {
+			var err error
+			if b, err = buildAtomFeed(md); err != nil {
+				log.Printf("build atom feed failed: %s\n", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			s.feed.set(b)
+		}
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Write(b) // nolint:errcheck
+	}
+}
+
+func (s *Server) sitemapHandler(md *MD) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := s.sitemap.get()
+		if !ok {
+			var err error
+			if b, err = buildSitemap(md); err != nil {
+				log.Printf("build sitemap failed: %s\n", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+				return
+			}
+			s.sitemap.set(b)
+		}
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.Write(b) // nolint:errcheck
+	}
+}
+
+// buildAtomFeed renders the Opt.FeedSize most recently modified posts as
+// an Atom feed.
+func buildAtomFeed(md *MD) ([]byte, error) {
+	all, err := md.All()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Time.After(all[j].Time) })
+	if len(all) > md.Opt.FeedSize {
+		all = all[:md.Opt.FeedSize]
+	}
+
+	url := absURL(md.Opt.BaseURL)
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<feed xmlns=\"http://www.w3.org/2005/Atom\">\n")
+	fmt.Fprintf(&buf, "  <title>%s</title>\n", template.HTMLEscapeString(md.Opt.Brand))
+	fmt.Fprintf(&buf, "  <link href=%q/>\n", url("/feed.atom"))
+	fmt.Fprintf(&buf, "  <id>%s</id>\n", url("/"))
+	if len(all) > 0 {
+		fmt.Fprintf(&buf, "  <updated>%s</updated>\n", all[0].Time.Format(time.RFC3339))
+	}
+
+	for _, shallow := range all {
+		post, err := md.Post(filepath.Join(md.root, shallow.Path))
+		if err != nil {
+			log.Printf("%s: %s (skipped from feed)\n", shallow.Path, err)
+			continue
+		}
+		summary := post.Description
+		if summary == "" {
+			summary = firstParagraph(post.HTML)
+		}
+		link := url(foldIndexURL(strings.TrimSuffix(shallow.Path, md.ext)))
+		buf.WriteString("  <entry>\n")
+		fmt.Fprintf(&buf, "    <title>%s</title>\n", template.HTMLEscapeString(post.Title))
+		fmt.Fprintf(&buf, "    <link href=%q/>\n", link)
+		fmt.Fprintf(&buf, "    <id>%s</id>\n", tagURI(md.Opt.BaseURL, post.Time, shallow.Path))
+		fmt.Fprintf(&buf, "    <updated>%s</updated>\n", post.Time.Format(time.RFC3339))
+		fmt.Fprintf(&buf, "    <summary>%s</summary>\n", template.HTMLEscapeString(summary))
+		buf.WriteString("  </entry>\n")
+	}
+	buf.WriteString("</feed>\n")
+	return buf.Bytes(), nil
+}
+
+// buildSitemap enumerates every markdown file, cached or not, as a
+// sitemap.xml <url> entry.
+func buildSitemap(md *MD) ([]byte, error) {
+	all, err := md.All()
+	if err != nil {
+		return nil, err
+	}
+	url := absURL(md.Opt.BaseURL)
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<urlset xmlns=\"http://www.sitemaps.org/schemas/sitemap/0.9\">\n")
+	for _, p := range all {
+		loc := url(foldIndexURL(strings.TrimSuffix(p.Path, md.ext)))
+		fmt.Fprintf(&buf, "  <url><loc>%s</loc><lastmod>%s</lastmod></url>\n",
+			loc, p.Time.Format("2006-01-02"))
+	}
+	buf.WriteString("</urlset>\n")
+	return buf.Bytes(), nil
+}
+
+// tagURI builds a tag:<host>,<yyyy-mm-dd>:<path> URI from baseURL's
+// host (or "localhost" without one), t's date and path. It does not
+// depend on the post's link URL, but it changes whenever baseURL, t or
+// path changes.
+func tagURI(baseURL string, t time.Time, path string) string {
+	host := baseURL
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host = strings.TrimSuffix(host, "/")
+	if host == "" {
+		host = "localhost"
+	}
+	return fmt.Sprintf("tag:%s,%s:%s", host, t.Format("2006-01-02"), path)
+}
+
+var (
+	paragraphRe = regexp.MustCompile(`(?s)<p(?:\s[^>]*)?>(.*?)</p>`)
+	tagStripRe  = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// firstParagraph pulls the plain text of a post's first <p> out of its
+// rendered HTML, used as a feed summary when there's no description in
+// the frontmatter.
+func firstParagraph(h template.HTML) string {
+	m := paragraphRe.FindStringSubmatch(string(h))
+	if m == nil {
+		return ""
+	}
+	return strings.TrimSpace(tagStripRe.ReplaceAllString(m[1], ""))
+}
+
+// Builder renders every markdown file under md.root into static HTML
+// using the same MD cache and templates the HTTP handlers use, so a
+// -build export behaves identically to the served site.
+type Builder struct {
+	md     *MD
+	tpl    *template.Template
+	html   string
+	assets string
+	outdir string
+}
+
+func NewBuilder(md *MD, tpl *template.Template, html, assets, outdir string) *Builder {
+	return &Builder{md: md, tpl: tpl, html: html, assets: assets, outdir: outdir}
+}
+
+// Build walks md.root, writing outdir/<category>/index.html for every
+// directory and outdir/<category>/<slug>/index.html for every non-draft
+// post, then outdir/index.html (the Hot listing), then copies static/
+// and assets/ verbatim.
+func (b *Builder) Build() error {
+	if err := os.MkdirAll(b.outdir, 0755); err != nil {
+		return err
+	}
+	// buildDir must run first: it's what loads every post into md's
+	// cache, and buildIndex's Hot() listing reads that same cache, so
+	// built before buildDir it would always render an empty homepage.
+	if err := b.buildDir(b.md.root); err != nil {
+		return fmt.Errorf("ink: build %s: %w", b.md.root, err)
+	}
+	if err := b.buildIndex(); err != nil {
+		return fmt.Errorf("ink: build index: %w", err)
+	}
+	if err := copyTree(filepath.Join(b.html, "static"), filepath.Join(b.outdir, "static")); err != nil {
+		return fmt.Errorf("ink: copy static: %w", err)
+	}
+	if err := copyTree(b.assets, filepath.Join(b.outdir, "assets")); err != nil {
+		return fmt.Errorf("ink: copy assets: %w", err)
+	}
+	return nil
+}
+
+func (b *Builder) buildIndex() error {
+	ps, err := b.md.Hot()
+	if err != nil {
+		return err
+	}
+	return b.render("index", &ListView{
+		Option:     b.md.Opt,
+		List:       ps,
+		Count:      len(ps),
+		Title:      b.md.Opt.Brand,
+		Categories: b.md.dirs.List(),
+	}, filepath.Join(b.outdir, "index.html"))
+}
+
+func (b *Builder) buildDir(dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		path := filepath.Join(dir, fi.Name())
+		if fi.IsDir() {
+			listOpts := ListOptions{Sort: "name", Order: "asc"}
+			list, numDirs, numFiles, err := b.md.List(path, listOpts)
+			if err != nil {
+				return err
+			}
+			name := b.md.Clean(path)
+			if err := b.render("posts", &ListView{
+				Option:   b.md.Opt,
+				List:     list,
+				Title:    name,
+				Count:    len(list),
+				NumDirs:  numDirs,
+				NumFiles: numFiles,
+				Sort:     listOpts.Sort,
+				Order:    listOpts.Order,
+				CanGoUp:  path != b.md.root,
+			}, filepath.Join(b.outdir, name, "index.html")); err != nil {
+				return err
+			}
+			if err := b.buildDir(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if !b.md.Is(path) {
+			continue
+		}
+		post, err := b.md.Post(path)
+		if err != nil {
+			return err
+		}
+		if post.Draft {
+			continue
+		}
+		_, slug := parse(post.Path)
+		if post.Category == "" && slug == "index" {
+			// The root index is always the Hot() listing written by
+			// buildIndex, matching the server's "/" route, which never
+			// falls back to rendering md/index.md as a post.
+			continue
+		}
+		if err := b.render("post", &PostView{Option: b.md.Opt, Post: post}, b.outPath(post, slug)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outPath maps a post onto outdir/<category>/<slug>/index.html, folding
+// an "index" post onto its own directory's index.html. slug must come
+// from the filename (see parse), not Post.Title: Post.Load overwrites
+// Title with the frontmatter title, which may contain spaces or
+// punctuation that the site's own links (built from the filename) never
+// point at.
+func (b *Builder) outPath(p *Post, slug string) string {
+	if slug == "index" {
+		return filepath.Join(b.outdir, p.Category, "index.html")
+	}
+	return filepath.Join(b.outdir, p.Category, slug, "index.html")
+}
+
+func (b *Builder) render(name string, data interface{}, out string) error {
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.tpl.ExecuteTemplate(f, name, data)
+}
+
+// copyTree copies src onto dst, file or directory, skipping silently if
+// src is unset or does not exist (e.g. a site with no assets/
+// directory). It refuses to copy a directory that contains dst, which
+// would otherwise walk the output directory back into itself.
+func copyTree(src, dst string) error {
+	if src == "" {
+		return nil
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !fi.IsDir() {
+		return copyFile(src, dst)
+	}
+
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	if absDst == absSrc || strings.HasPrefix(absDst, absSrc+string(filepath.Separator)) {
+		return fmt.Errorf("ink: refusing to copy %s into itself via output directory %s", src, dst)
+	}
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	return dfs(src, func(path string, fi os.FileInfo) error {
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
 type PostView struct {
 	*Option
 	*Post
@@ -478,6 +1429,34 @@ type ListView struct {
 	Count int
 
 	Categories []*Category
+
+	// Directory-listing controls, set for the "posts" template.
+	NumDirs        int
+	NumFiles       int
+	ItemsLimitedTo int // 0 means the listing wasn't limited
+	Sort           string
+	Order          string
+	CanGoUp        bool
+}
+
+// parseListOptions reads ?sort=&order=&limit=&offset= off a directory
+// listing request, defaulting to name/asc/unlimited.
+func parseListOptions(q url.Values) ListOptions {
+	opts := ListOptions{Sort: "name", Order: "asc"}
+	switch s := q.Get("sort"); s {
+	case "size", "time":
+		opts.Sort = s
+	}
+	if q.Get("order") == "desc" {
+		opts.Order = "desc"
+	}
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		opts.Limit = n
+	}
+	if n, err := strconv.Atoi(q.Get("offset")); err == nil && n > 0 {
+		opts.Offset = n
+	}
+	return opts
 }
 
 var (
@@ -485,6 +1464,8 @@ var (
 	md     string
 	html   string
 	assets string
+	dev    bool
+	build  string
 )
 
 func init() {
@@ -492,22 +1473,58 @@ func init() {
 	flag.StringVar(&md, "md", "md", "markdown filepath")
 	flag.StringVar(&html, "html", "html", "html template filepath")
 	flag.StringVar(&assets, "assets", ".", "assets filepath")
+	flag.BoolVar(&dev, "dev", false, "run in development mode (show drafts, enable live reload)")
+	flag.StringVar(&build, "build", "", "build the site as static HTML into this directory and exit")
 }
 
 func main() {
 	flag.Parse()
 
-	m := New(md, ".md")
+	m := New(md, ".md", dev)
+
+	if build != "" {
+		tpl := newTemplate(html, assets, m.Opt.BaseURL, false)
+		// -assets defaults to "." for the server, where it just serves
+		// /assets/* out of the working directory; exporting that
+		// default verbatim would copy the whole repo (.git, main.go,
+		// ...) into the output, so only copy it when the user asked.
+		buildAssets := assets
+		if !flagSet("assets") {
+			buildAssets = ""
+		}
+		b := NewBuilder(m, tpl, html, buildAssets, build)
+		if err := b.Build(); err != nil {
+			log.Fatalf("ink: build failed: %s\n", err)
+		}
+		log.Printf("ink: built site into %s\n", build)
+		return
+	}
+
 	go m.Watch()
 
 	s := NewServer(html, assets)
 	s.Handle(m)
 
+	closing := make(chan struct{})
+	done := make(chan struct{})
 	go shutdown(func() {
+		close(closing)
 		m.Close()
 		log.Println("ink: closed")
-		s.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(m.Opt.ShutdownTimeout)*time.Second)
+		defer cancel()
+		if err := s.Close(ctx); err != nil {
+			log.Printf("ink: shutdown: %s\n", err)
+		}
+		close(done)
 	})
 
-	s.Start(fmt.Sprintf(":%d", port))
+	s.Start(fmt.Sprintf(":%d", port), m.Opt)
+	// Start returns as soon as shutdown begins; wait for the drain to
+	// finish before exiting, unless Start returned on its own.
+	select {
+	case <-closing:
+		<-done
+	default:
+	}
 }
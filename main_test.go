@@ -0,0 +1,203 @@
+package main
+
+import (
+	"html/template"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMarkdownOptionSetDefaults guards against regressing to plain
+// bools, where an explicit false for one extension couldn't be told
+// apart from the others being left unset, and so got silently
+// overridden back to true.
+func TestMarkdownOptionSetDefaults(t *testing.T) {
+	off := false
+	m := MarkdownOption{GFM: &off}
+	m.setDefaults()
+	if *m.GFM {
+		t.Errorf("setDefaults() re-enabled GFM after it was explicitly set to false")
+	}
+	if m.Emoji == nil || !*m.Emoji {
+		t.Errorf("setDefaults() left Emoji unset, want defaulted to true")
+	}
+	if m.Mermaid == nil || !*m.Mermaid {
+		t.Errorf("setDefaults() left Mermaid unset, want defaulted to true")
+	}
+	if m.AutoHeadingID == nil || !*m.AutoHeadingID {
+		t.Errorf("setDefaults() left AutoHeadingID unset, want defaulted to true")
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string // RFC3339, UTC
+		wantErr bool
+	}{
+		{"2024-03-05", "2024-03-05T00:00:00Z", false},
+		{"2024-03-05T10:30:00Z", "2024-03-05T10:30:00Z", false},
+		{"2024-03-05 10:30:00", "2024-03-05T10:30:00Z", false},
+		{"not-a-date", "", true},
+	}
+	for _, c := range cases {
+		got, err := parseDate(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseDate(%q): expected an error, got %v", c.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseDate(%q): unexpected error: %s", c.in, err)
+		}
+		if s := got.UTC().Format(time.RFC3339); s != c.want {
+			t.Errorf("parseDate(%q) = %s, want %s", c.in, s, c.want)
+		}
+	}
+}
+
+func TestParseSlug(t *testing.T) {
+	cases := []struct {
+		path, category, slug string
+	}{
+		{"md/blog/hello.md", "blog", "hello"},
+		{"md/index.md", "", "index"},
+		{"md/blog/index.md", "blog", "index"},
+	}
+	for _, c := range cases {
+		category, slug := parse(c.path)
+		if category != c.category || slug != c.slug {
+			t.Errorf("parse(%q) = (%q, %q), want (%q, %q)", c.path, category, slug, c.category, c.slug)
+		}
+	}
+}
+
+// TestBuilderOutPath guards against regressing to Post.Title (the
+// frontmatter title, which may contain spaces or punctuation) instead
+// of the filename-derived slug when mapping a post onto its output
+// file.
+func TestBuilderOutPath(t *testing.T) {
+	b := &Builder{outdir: "public"}
+	cases := []struct {
+		category, slug, want string
+	}{
+		{"", "index", "public/index.html"},
+		{"blog", "index", "public/blog/index.html"},
+		{"blog", "hello", "public/blog/hello/index.html"},
+	}
+	for _, c := range cases {
+		p := &Post{Category: c.category, Title: "Hello, World!"}
+		got := b.outPath(p, c.slug)
+		want := filepath.FromSlash(c.want)
+		if got != want {
+			t.Errorf("outPath(category=%q, slug=%q) = %s, want %s", c.category, c.slug, got, want)
+		}
+	}
+}
+
+func TestFoldIndexURL(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{"index", "/"},
+		{"", "/"},
+		{"blog/index", "/blog"},
+		{"blog/hello", "/blog/hello"},
+	}
+	for _, c := range cases {
+		if got := foldIndexURL(c.in); got != c.want {
+			t.Errorf("foldIndexURL(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestTagURI(t *testing.T) {
+	ts := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		baseURL, path, want string
+	}{
+		{"https://example.com", "blog/hello.md", "tag:example.com,2024-03-05:blog/hello.md"},
+		{"https://example.com/", "blog/hello.md", "tag:example.com,2024-03-05:blog/hello.md"},
+		{"", "blog/hello.md", "tag:localhost,2024-03-05:blog/hello.md"},
+	}
+	for _, c := range cases {
+		got := tagURI(c.baseURL, ts, c.path)
+		if got != c.want {
+			t.Errorf("tagURI(%q, ..., %q) = %s, want %s", c.baseURL, c.path, got, c.want)
+		}
+	}
+}
+
+func TestFirstParagraph(t *testing.T) {
+	cases := []struct {
+		html, want string
+	}{
+		{"<p>Hello <b>world</b>.</p><p>Second.</p>", "Hello world."},
+		{"<h1>Title</h1><p>  padded  </p>", "padded"},
+		{"<h1>No paragraph here</h1>", ""},
+	}
+	for _, c := range cases {
+		got := firstParagraph(template.HTML(c.html))
+		if got != c.want {
+			t.Errorf("firstParagraph(%q) = %q, want %q", c.html, got, c.want)
+		}
+	}
+}
+
+func TestSortPosts(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newPosts := func() []*Post {
+		return []*Post{
+			{Title: "Banana", Size: 30, Time: now.Add(-1 * time.Hour)},
+			{Title: "apple", Size: 10, Time: now.Add(-2 * time.Hour)},
+			{Title: "Cherry", Size: 20, Time: now},
+		}
+	}
+	titles := func(ps []*Post) []string {
+		out := make([]string, len(ps))
+		for i, p := range ps {
+			out[i] = p.Title
+		}
+		return out
+	}
+
+	cases := []struct {
+		by, order string
+		want      []string
+	}{
+		{"name", "asc", []string{"apple", "Banana", "Cherry"}},
+		{"name", "desc", []string{"Cherry", "Banana", "apple"}},
+		{"size", "asc", []string{"apple", "Cherry", "Banana"}},
+		{"time", "asc", []string{"apple", "Banana", "Cherry"}},
+	}
+	for _, c := range cases {
+		ps := newPosts()
+		sortPosts(ps, c.by, c.order)
+		got := titles(ps)
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("sortPosts(by=%q, order=%q) = %v, want %v", c.by, c.order, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHumanTime(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		ago  time.Duration
+		want string
+	}{
+		{10 * time.Second, "just now"},
+		{5 * time.Minute, "5 minutes ago"},
+		{1 * time.Minute, "1 minute ago"},
+		{2 * time.Hour, "2 hours ago"},
+		{3 * 24 * time.Hour, "3 days ago"},
+	}
+	for _, c := range cases {
+		got := humanTime(now.Add(-c.ago))
+		if got != c.want {
+			t.Errorf("humanTime(now-%s) = %q, want %q", c.ago, got, c.want)
+		}
+	}
+}